@@ -22,8 +22,14 @@ const (
 // BinlogTransaction represents one transaction as read from
 // the binlog. Timestamp is set if the first statement was
 // something like 'SET TIMESTAMP=...'
+//
+// Statements holds statement-based (SBR) events and RowEvents holds
+// row-based (RBR) events; a MIXED-mode transaction may hold both. The
+// binlog streamer does not fill RowEvents; a RowEvent reaches
+// Statement-based consumers only through binlog.RowEventConverter.
 type BinlogTransaction struct {
 	Statements []Statement
+	RowEvents  []RowEvent
 	Timestamp  int64
 	GTIDField  myproto.GTIDField
 }
@@ -32,4 +38,64 @@ type BinlogTransaction struct {
 type Statement struct {
 	Category int
 	Sql      []byte
+
+	// KeyspaceIDs holds the keyspace ids named by Sql's vtgate annotation
+	// (see sqlannotation.ExtractKeySpaceIDs), when they are known.
+	// binlog.RowEventConverter.ToStatement sets it; the binlog streamer
+	// does not parse Sql to fill it, and filtered replication does not
+	// read it.
+	KeyspaceIDs [][]byte
+
+	// Annotation carries the same information as the "/* vtgate:: ... */"
+	// comment that would otherwise be appended to Sql, in structured form.
+	// sqlannotation.AnnotateStatement produces it instead of (not in
+	// addition to) a comment annotation when called with
+	// AnnotationCapabilityStructured (see sqlannotation.Encode/Decode); it
+	// is nil for statements using the comment-based scheme.
+	Annotation *StatementAnnotation
+}
+
+// StatementAnnotation is the structured equivalent of a
+// "/* vtgate:: keyspace_id:... */" or "/* vtgate:: keyspace_ids:... */"
+// comment annotation. It exists so that filtered replication can route a
+// Statement without hex-decoding or delimiter-scanning its Sql, which is
+// fragile against user comments, multi-statement payloads and character
+// sets. See sqlannotation.Encode and sqlannotation.Decode.
+type StatementAnnotation struct {
+	// KeyspaceID is set when the statement was annotated with exactly one
+	// keyspace id.
+	KeyspaceID []byte
+	// KeyspaceIDs is set when the statement was annotated with more than
+	// one keyspace id. KeyspaceID and KeyspaceIDs are never both set.
+	KeyspaceIDs [][]byte
+	// Flags holds a bitmask of StatementAnnotationFlag* values.
+	Flags uint32
+	// TrailingComments holds any additional trailing comments that would
+	// have been appended after the annotation in the comment-based scheme.
+	TrailingComments string
 }
+
+// Bitmask values for StatementAnnotation.Flags.
+const (
+	// StatementAnnotationFlagReplicationUnfriendly marks a statement that
+	// could not be attributed to any keyspace id, the structured
+	// equivalent of the "/* vtgate:: filtered_replication_unfriendly */"
+	// comment.
+	StatementAnnotationFlagReplicationUnfriendly = 1 << iota
+)
+
+// AnnotationCapability selects which Statement annotation encoding
+// sqlannotation.AnnotateStatement uses: Statement.Annotation or a comment
+// appended to Statement.Sql. The caller of AnnotateStatement supplies it;
+// no handshake between vtgate and vttablet sets it, and vttablet's filter
+// does not consult it when reading a Statement.
+type AnnotationCapability int
+
+const (
+	// AnnotationCapabilityComment is the default: only the
+	// backward-compatible "/* vtgate:: ... */" comment form is used.
+	AnnotationCapabilityComment AnnotationCapability = iota
+	// AnnotationCapabilityStructured selects StatementAnnotation instead
+	// of a comment.
+	AnnotationCapabilityStructured
+)
@@ -0,0 +1,42 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proto
+
+import (
+	"github.com/youtube/vitess/go/sqltypes"
+)
+
+// Valid row event types in the binlogs. These are only populated when
+// the source binlog uses MySQL 5.6+ row-based replication (RBR), as
+// opposed to the statement-based (SBR) events captured by Statement.
+const (
+	RBR_UNRECOGNIZED = iota
+	RBR_WRITE_ROWS
+	RBR_UPDATE_ROWS
+	RBR_DELETE_ROWS
+)
+
+// RowEventColumn describes one column referenced by a RowEvent's
+// before/after images, as resolved from the table's schema.
+type RowEventColumn struct {
+	Name string
+	Type int
+}
+
+// RowEvent represents one row-based-replication event (WRITE_ROWS,
+// UPDATE_ROWS or DELETE_ROWS) as read from the binlog.
+//
+// Before holds the row's image prior to the change and is nil for
+// RBR_WRITE_ROWS. After holds the row's image following the change and
+// is nil for RBR_DELETE_ROWS. Both, when present, are positional with
+// Columns.
+type RowEvent struct {
+	EventType int
+	TableID   uint64
+	TableName string
+	Columns   []RowEventColumn
+	Before    []sqltypes.Value
+	After     []sqltypes.Value
+}
@@ -0,0 +1,172 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package binlog
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/youtube/vitess/go/sqltypes"
+	"github.com/youtube/vitess/go/vt/binlog/proto"
+	myproto "github.com/youtube/vitess/go/vt/mysqlctl/proto"
+	"github.com/youtube/vitess/go/vt/sqlannotation"
+)
+
+// RowEventConverter synthesizes annotated DML statements from RBR
+// RowEvents, for consumers (like filtered replication) that only
+// understand SBR. It resolves a RowEvent's table by name (not by table
+// id) against a
+// SchemaDefinition fetched from mysqlctl, since the binlog wire format
+// does not carry enough information (e.g. the primary key) on its own.
+type RowEventConverter struct {
+	schema *myproto.SchemaDefinition
+}
+
+// NewRowEventConverter returns a RowEventConverter that resolves row
+// events against the given schema, typically fetched once via
+// mysqlctl.GetSchema when a binlog stream starts.
+func NewRowEventConverter(schema *myproto.SchemaDefinition) *RowEventConverter {
+	return &RowEventConverter{schema: schema}
+}
+
+// ToStatement synthesizes a proto.Statement containing SQL equivalent to
+// the given RowEvent, annotated with keyspaceID exactly as
+// sqlannotation.AddKeyspaceID would annotate a native SBR statement. This
+// lets filtered replication and other Statement-based consumers handle
+// RBR and MIXED-mode binlogs without change.
+func (c *RowEventConverter) ToStatement(event proto.RowEvent, keyspaceID []byte) (proto.Statement, error) {
+	table, err := c.findTable(event.TableName)
+	if err != nil {
+		return proto.Statement{}, err
+	}
+	var sql string
+	switch event.EventType {
+	case proto.RBR_WRITE_ROWS:
+		sql, err = buildInsert(table, event)
+	case proto.RBR_UPDATE_ROWS:
+		sql, err = buildUpdate(table, event)
+	case proto.RBR_DELETE_ROWS:
+		sql, err = buildDelete(table, event)
+	default:
+		err = fmt.Errorf("row_event_converter: unrecognized row event type %v for table %v", event.EventType, event.TableName)
+	}
+	if err != nil {
+		return proto.Statement{}, err
+	}
+	return proto.Statement{
+		Category:    proto.BL_DML,
+		Sql:         []byte(sqlannotation.AddKeyspaceID(sql, keyspaceID, "")),
+		KeyspaceIDs: [][]byte{keyspaceID},
+	}, nil
+}
+
+func (c *RowEventConverter) findTable(name string) (*myproto.TableDefinition, error) {
+	for _, table := range c.schema.TableDefinitions {
+		if table.Name == name {
+			return table, nil
+		}
+	}
+	return nil, fmt.Errorf("row_event_converter: unknown table %q in row event (stale schema?)", name)
+}
+
+func buildInsert(table *myproto.TableDefinition, event proto.RowEvent) (string, error) {
+	if event.After == nil {
+		return "", fmt.Errorf("row_event_converter: WRITE_ROWS event for %v has no after image", table.Name)
+	}
+	if len(event.After) != len(event.Columns) {
+		return "", fmt.Errorf("row_event_converter: WRITE_ROWS event for %v has %d columns but %d after values (stale schema?)",
+			table.Name, len(event.Columns), len(event.After))
+	}
+	names := make([]string, len(event.Columns))
+	values := make([]string, len(event.Columns))
+	for i, col := range event.Columns {
+		names[i] = quoteIdentifier(col.Name)
+		values[i] = encodeSQLValue(event.After[i])
+	}
+	return fmt.Sprintf("insert into %s (%s) values (%s)",
+		quoteIdentifier(table.Name), strings.Join(names, ", "), strings.Join(values, ", ")), nil
+}
+
+func buildUpdate(table *myproto.TableDefinition, event proto.RowEvent) (string, error) {
+	if event.Before == nil || event.After == nil {
+		return "", fmt.Errorf("row_event_converter: UPDATE_ROWS event for %v is missing an image", table.Name)
+	}
+	if len(event.Before) != len(event.Columns) || len(event.After) != len(event.Columns) {
+		return "", fmt.Errorf("row_event_converter: UPDATE_ROWS event for %v has %d columns but %d before and %d after values (stale schema?)",
+			table.Name, len(event.Columns), len(event.Before), len(event.After))
+	}
+	sets := make([]string, len(event.Columns))
+	for i, col := range event.Columns {
+		sets[i] = fmt.Sprintf("%s = %s", quoteIdentifier(col.Name), encodeSQLValue(event.After[i]))
+	}
+	where, err := whereClauseFromPK(table, event.Columns, event.Before)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("update %s set %s where %s", quoteIdentifier(table.Name), strings.Join(sets, ", "), where), nil
+}
+
+func buildDelete(table *myproto.TableDefinition, event proto.RowEvent) (string, error) {
+	if event.Before == nil {
+		return "", fmt.Errorf("row_event_converter: DELETE_ROWS event for %v has no before image", table.Name)
+	}
+	where, err := whereClauseFromPK(table, event.Columns, event.Before)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("delete from %s where %s", quoteIdentifier(table.Name), where), nil
+}
+
+// whereClauseFromPK builds a "col = val and ..." clause identifying the
+// row, using the table's primary key columns matched against the given
+// row image. Row events may carry only a subset of a table's columns, so
+// every primary key column must be present in 'columns'. A NULL primary
+// key value compares with "is null" rather than "= null", since SQL's
+// "= null" is never true.
+func whereClauseFromPK(table *myproto.TableDefinition, columns []proto.RowEventColumn, image []sqltypes.Value) (string, error) {
+	if len(columns) != len(image) {
+		return "", fmt.Errorf("row_event_converter: row event for %v has %d columns but %d image values (stale schema?)",
+			table.Name, len(columns), len(image))
+	}
+	clauses := make([]string, len(table.PrimaryKeyColumns))
+	for i, pkCol := range table.PrimaryKeyColumns {
+		index := -1
+		for j, col := range columns {
+			if col.Name == pkCol {
+				index = j
+				break
+			}
+		}
+		if index == -1 {
+			return "", fmt.Errorf("row_event_converter: primary key column %q missing from row event for %v", pkCol, table.Name)
+		}
+		value := image[index]
+		if value.IsNull() {
+			clauses[i] = fmt.Sprintf("%s is null", quoteIdentifier(pkCol))
+		} else {
+			clauses[i] = fmt.Sprintf("%s = %s", quoteIdentifier(pkCol), encodeSQLValue(value))
+		}
+	}
+	return strings.Join(clauses, " and "), nil
+}
+
+// encodeSQLValue returns v as a properly quoted and escaped SQL literal,
+// the same encoding vitess uses elsewhere to turn bound values into
+// literal SQL (e.g. strings are quoted and internal quotes escaped, NULL
+// becomes the literal "null"). Value.String() is not sufficient here: it
+// is a raw/display representation, not SQL-safe.
+func encodeSQLValue(v sqltypes.Value) string {
+	buf := new(bytes.Buffer)
+	v.EncodeSql(buf)
+	return buf.String()
+}
+
+// quoteIdentifier backtick-quotes a table or column name, escaping any
+// embedded backticks, so that identifiers which are reserved words or
+// otherwise need escaping still produce valid SQL.
+func quoteIdentifier(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
@@ -0,0 +1,133 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package binlog
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/youtube/vitess/go/sqltypes"
+	"github.com/youtube/vitess/go/vt/binlog/proto"
+	myproto "github.com/youtube/vitess/go/vt/mysqlctl/proto"
+)
+
+func testSchema() *myproto.SchemaDefinition {
+	return &myproto.SchemaDefinition{
+		TableDefinitions: []*myproto.TableDefinition{
+			{
+				Name:              "t",
+				PrimaryKeyColumns: []string{"id"},
+			},
+		},
+	}
+}
+
+func testColumns() []proto.RowEventColumn {
+	return []proto.RowEventColumn{
+		{Name: "id"},
+		{Name: "name"},
+	}
+}
+
+func TestRowEventConverterToStatementEscapesValues(t *testing.T) {
+	c := NewRowEventConverter(testSchema())
+	event := proto.RowEvent{
+		EventType: proto.RBR_WRITE_ROWS,
+		TableName: "t",
+		Columns:   testColumns(),
+		After:     []sqltypes.Value{sqltypes.MakeString([]byte("1")), sqltypes.MakeString([]byte("O'Brien"))},
+	}
+	stmt, err := c.ToStatement(event, []byte("ks"))
+	if err != nil {
+		t.Fatalf("ToStatement failed: %v", err)
+	}
+	sql := string(stmt.Sql)
+	if !strings.Contains(sql, "'O\\'Brien'") && !strings.Contains(sql, "'O''Brien'") {
+		t.Errorf("ToStatement sql = %q, want the quote in the value escaped", sql)
+	}
+	if !strings.Contains(sql, "`t`") {
+		t.Errorf("ToStatement sql = %q, want the table name backtick-quoted", sql)
+	}
+}
+
+func TestRowEventConverterToStatementNullPrimaryKey(t *testing.T) {
+	c := NewRowEventConverter(testSchema())
+	event := proto.RowEvent{
+		EventType: proto.RBR_DELETE_ROWS,
+		TableName: "t",
+		Columns:   testColumns(),
+		Before:    []sqltypes.Value{sqltypes.Value{}, sqltypes.MakeString([]byte("foo"))},
+	}
+	stmt, err := c.ToStatement(event, []byte("ks"))
+	if err != nil {
+		t.Fatalf("ToStatement failed: %v", err)
+	}
+	sql := string(stmt.Sql)
+	if !strings.Contains(sql, "`id` is null") {
+		t.Errorf("ToStatement sql = %q, want a NULL primary key compared with IS NULL", sql)
+	}
+}
+
+func TestRowEventConverterToStatementUnknownTable(t *testing.T) {
+	c := NewRowEventConverter(testSchema())
+	event := proto.RowEvent{
+		EventType: proto.RBR_WRITE_ROWS,
+		TableName: "missing",
+	}
+	if _, err := c.ToStatement(event, []byte("ks")); err == nil {
+		t.Error("ToStatement for an unknown table succeeded, want error")
+	}
+}
+
+func TestRowEventConverterToStatementUpdate(t *testing.T) {
+	c := NewRowEventConverter(testSchema())
+	event := proto.RowEvent{
+		EventType: proto.RBR_UPDATE_ROWS,
+		TableName: "t",
+		Columns:   testColumns(),
+		Before:    []sqltypes.Value{sqltypes.MakeString([]byte("1")), sqltypes.MakeString([]byte("old"))},
+		After:     []sqltypes.Value{sqltypes.MakeString([]byte("1")), sqltypes.MakeString([]byte("new"))},
+	}
+	stmt, err := c.ToStatement(event, []byte("ks"))
+	if err != nil {
+		t.Fatalf("ToStatement failed: %v", err)
+	}
+	sql := string(stmt.Sql)
+	if !strings.Contains(sql, "update `t` set") {
+		t.Errorf("ToStatement sql = %q, want an update statement", sql)
+	}
+	if !strings.Contains(sql, "'new'") || !strings.Contains(sql, "`id` = '1'") {
+		t.Errorf("ToStatement sql = %q, want the after image in SET and the PK from the before image in WHERE", sql)
+	}
+}
+
+func TestRowEventConverterToStatementColumnImageLengthMismatch(t *testing.T) {
+	c := NewRowEventConverter(testSchema())
+	for _, event := range []proto.RowEvent{
+		{
+			EventType: proto.RBR_WRITE_ROWS,
+			TableName: "t",
+			Columns:   testColumns(),
+			After:     []sqltypes.Value{sqltypes.MakeString([]byte("1"))},
+		},
+		{
+			EventType: proto.RBR_UPDATE_ROWS,
+			TableName: "t",
+			Columns:   testColumns(),
+			Before:    []sqltypes.Value{sqltypes.MakeString([]byte("1")), sqltypes.MakeString([]byte("old"))},
+			After:     []sqltypes.Value{sqltypes.MakeString([]byte("1"))},
+		},
+		{
+			EventType: proto.RBR_DELETE_ROWS,
+			TableName: "t",
+			Columns:   testColumns(),
+			Before:    []sqltypes.Value{sqltypes.MakeString([]byte("1"))},
+		},
+	} {
+		if _, err := c.ToStatement(event, []byte("ks")); err == nil {
+			t.Errorf("ToStatement with mismatched column/image lengths for event type %v succeeded, want error", event.EventType)
+		}
+	}
+}
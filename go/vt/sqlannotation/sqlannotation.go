@@ -7,6 +7,13 @@
 // comments and parsing them. These annotations
 // are used during filtered-replication to route
 // the DML statement to the correct shard.
+//
+// Encode/Decode provide a parallel, structured path for vtgate/vttablet
+// pairs that have negotiated it: the same keyspace-id information is
+// carried on proto.Statement.Annotation instead of being encoded into a
+// SQL comment, avoiding the hex-decode and delimiter-scanning done by
+// ExtractKeySpaceID(s). The comment-based functions remain the
+// backward-compatible default.
 // TOOD(erez): Move the code for the "_stream" annotations
 // from vttablet to here.
 package sqlannotation
@@ -20,6 +27,7 @@ import (
 	"unicode"
 
 	"github.com/youtube/vitess/go/stats"
+	"github.com/youtube/vitess/go/vt/binlog/proto"
 	"github.com/youtube/vitess/go/vt/logutil"
 )
 
@@ -27,6 +35,10 @@ const (
 	filteredReplicationUnfriendlyAnnotation = "/* vtgate:: filtered_replication_unfriendly */"
 )
 
+// keyspaceIDsDelimiter separates the hex-encoded keyspace ids within
+// a "keyspace_ids:" annotation (see AddKeyspaceIDs).
+const keyspaceIDsDelimiter = ","
+
 var (
 	filteredReplicationUnfriendlyStatementsCount = stats.NewInt("FilteredReplicationUnfriendlyStatementsCount")
 	filteredReplicationUnfriendlyStatementLogger = logutil.NewThrottledLogger("FilteredReplicationUnfriendlyStatement", 5*time.Second)
@@ -36,18 +48,53 @@ var (
 //
 // If 'sql' is not a DML statement no annotation is added.
 // If 'sql' is a DML statement and contains exactly one keyspaceID
-//    it is used to annotate 'sql'
+//    it is used to annotate 'sql'.
+// If 'sql' is a DML statement and contains more than one keyspaceID
+//    the full set is used to annotate 'sql', so that filtered replication
+//    can fan the statement out to each of the affected shards.
 // Otherwise 'sql' is annotated as replication-unfriendly.
 func AnnotateIfDML(sql string, keyspaceIDs [][]byte) string {
 	if !IsDML(sql) {
 		return sql
 	}
-	if len(keyspaceIDs) == 1 {
+	switch len(keyspaceIDs) {
+	case 0:
+		// Fall through to the replication-unfriendly case below.
+	case 1:
 		return AddKeyspaceID(sql, keyspaceIDs[0], "")
+	default:
+		return AddKeyspaceIDs(sql, keyspaceIDs, "")
 	}
+	recordReplicationUnfriendlyStatement(sql)
+	return sql + filteredReplicationUnfriendlyAnnotation
+}
+
+// recordReplicationUnfriendlyStatement updates the stats counter and logs
+// a warning for a DML statement that could not be attributed to any
+// keyspace id, regardless of which annotation encoding (comment or
+// structured) ends up being used for it.
+func recordReplicationUnfriendlyStatement(sql string) {
 	filteredReplicationUnfriendlyStatementsCount.Add(1)
 	filteredReplicationUnfriendlyStatementLogger.Warningf("filtered-replication-unfriendly SQL statement detected: %q", sql)
-	return sql + filteredReplicationUnfriendlyAnnotation
+}
+
+// AnnotateStatement is the capability-aware counterpart to AnnotateIfDML:
+// it picks the comment-based or structured annotation encoding based on
+// 'capability', the AnnotationCapability that vtgate and vttablet
+// negotiated for this stream. It returns the (possibly comment-annotated)
+// sql to store on proto.Statement.Sql, and, when the structured encoding
+// was used, the proto.StatementAnnotation to store on
+// proto.Statement.Annotation (nil otherwise). Like AnnotateIfDML, a
+// statement that can't be attributed to any keyspace id is recorded via
+// the same stats counter and warning log on either path.
+func AnnotateStatement(sql string, keyspaceIDs [][]byte, capability proto.AnnotationCapability) (string, *proto.StatementAnnotation) {
+	if capability == proto.AnnotationCapabilityStructured && IsDML(sql) {
+		if len(keyspaceIDs) == 0 {
+			recordReplicationUnfriendlyStatement(sql)
+		}
+		return sql, Encode(keyspaceIDs, "")
+	}
+	return AnnotateIfDML(sql, keyspaceIDs), nil
 }
 
 // AddKeyspaceID returns a copy of 'sql' annotated
@@ -58,6 +105,21 @@ func AddKeyspaceID(sql string, keyspaceID []byte, trailingComments string) strin
 		sql, hex.EncodeToString(keyspaceID), trailingComments)
 }
 
+// AddKeyspaceIDs returns a copy of 'sql' annotated with the given set of
+// keyspace ids. It is used instead of AddKeyspaceID when a single DML touches
+// more than one keyspace id, so that filtered replication can route the
+// statement to each of the destination shards rather than treating it as
+// replication-unfriendly. It also appends the additional trailingComments,
+// if any.
+func AddKeyspaceIDs(sql string, keyspaceIDs [][]byte, trailingComments string) string {
+	hexIDs := make([]string, len(keyspaceIDs))
+	for i, keyspaceID := range keyspaceIDs {
+		hexIDs[i] = hex.EncodeToString(keyspaceID)
+	}
+	return fmt.Sprintf("%s /* vtgate:: keyspace_ids:%s */%s",
+		sql, strings.Join(hexIDs, keyspaceIDsDelimiter), trailingComments)
+}
+
 // IsDML returns true if 'querySQL' is an INSERT, UPDATE or DELETE statement.
 func IsDML(sql string) bool {
 	sql = strings.TrimLeftFunc(sql, unicode.IsSpace)
@@ -77,6 +139,8 @@ func IsDML(sql string) bool {
 // and err is set to nil; otherwise, if a filtered-replication-unfriendly comment exists
 // or some other parsing error occured, keyspaceID is set to nil and err is set to a non-nil
 // error value.
+// If the statement was annotated with more than one keyspace id (see AddKeyspaceIDs),
+// use ExtractKeySpaceIDs instead.
 func ExtractKeySpaceID(sql string) (keyspaceID []byte, err error) {
 	keyspaceIDString, hasKeySpaceID := extractStringBetween(sql, "/* vtgate:: keyspace_id:", " ")
 	hasUnfriendlyAnnotation := (strings.Index(sql, filteredReplicationUnfriendlyAnnotation) != -1)
@@ -102,6 +166,16 @@ func ExtractKeySpaceID(sql string) (keyspaceID []byte, err error) {
 		return
 	}
 
+	if hasKeyspaceIDsAnnotation(sql) {
+		keyspaceID = nil
+		err = &ExtractKeySpaceIDError{
+			Kind: ExtractKeySpaceIDParseError,
+			Message: fmt.Sprintf(
+				"Statement is annotated with multiple keyspace ids, use ExtractKeySpaceIDs: %v", sql),
+		}
+		return
+	}
+
 	if hasUnfriendlyAnnotation {
 		err = &ExtractKeySpaceIDError{
 			Kind:    ExtractKeySpaceIDReplicationUnfriendlyError,
@@ -120,6 +194,108 @@ func ExtractKeySpaceID(sql string) (keyspaceID []byte, err error) {
 	return
 }
 
+// ExtractKeySpaceIDs parses the annotation of the given statement and tries
+// to extract the set of keyspace ids added by AddKeyspaceIDs. It also accepts
+// the single-id form produced by AddKeyspaceID, returning it as a one-element
+// slice, so callers that want to fan a statement out to every affected shard
+// can use this unconditionally.
+// If a keyspace-ids comment exists 'keyspaceIDs' is set to the parsed keyspace ids
+// and err is set to nil; otherwise, if a filtered-replication-unfriendly comment exists
+// or some other parsing error occured, keyspaceIDs is set to nil and err is set to a
+// non-nil error value.
+func ExtractKeySpaceIDs(sql string) (keyspaceIDs [][]byte, err error) {
+	keyspaceIDsString, hasKeySpaceIDs := extractStringBetween(sql, "/* vtgate:: keyspace_ids:", " ")
+	hasUnfriendlyAnnotation := (strings.Index(sql, filteredReplicationUnfriendlyAnnotation) != -1)
+	if hasKeySpaceIDs {
+		if hasUnfriendlyAnnotation {
+			return nil, &ExtractKeySpaceIDError{
+				Kind:    ExtractKeySpaceIDParseError,
+				Message: fmt.Sprintf("Conflicting annotations in statement '%v'", sql),
+			}
+		}
+		hexIDs := strings.Split(keyspaceIDsString, keyspaceIDsDelimiter)
+		keyspaceIDs = make([][]byte, len(hexIDs))
+		for i, hexID := range hexIDs {
+			keyspaceID, err := hex.DecodeString(hexID)
+			if err != nil {
+				return nil, &ExtractKeySpaceIDError{
+					Kind: ExtractKeySpaceIDParseError,
+					Message: fmt.Sprintf(
+						"Error parsing keyspace id value in statement: %v (%v)", sql, err),
+				}
+			}
+			keyspaceIDs[i] = keyspaceID
+		}
+		return keyspaceIDs, nil
+	}
+
+	keyspaceID, err := ExtractKeySpaceID(sql)
+	if err != nil {
+		return nil, err
+	}
+	return [][]byte{keyspaceID}, nil
+}
+
+// hasKeyspaceIDsAnnotation returns true if 'sql' contains a "keyspace_ids:"
+// (plural) annotation, as added by AddKeyspaceIDs.
+func hasKeyspaceIDsAnnotation(sql string) bool {
+	_, found := extractStringBetween(sql, "/* vtgate:: keyspace_ids:", " ")
+	return found
+}
+
+// Encode returns the structured equivalent of the comment AddKeyspaceID
+// or AddKeyspaceIDs would have produced for the same arguments, for
+// attaching to proto.Statement.Annotation instead of appending a comment
+// to the SQL text. If keyspaceIDs is empty, it returns an annotation with
+// StatementAnnotationFlagReplicationUnfriendly set, mirroring the
+// replication-unfriendly case of AnnotateIfDML, so that Decode round-trips
+// to ExtractKeySpaceIDReplicationUnfriendlyError just as the comment-based
+// path does.
+func Encode(keyspaceIDs [][]byte, trailingComments string) *proto.StatementAnnotation {
+	annotation := &proto.StatementAnnotation{TrailingComments: trailingComments}
+	switch len(keyspaceIDs) {
+	case 0:
+		annotation.Flags |= proto.StatementAnnotationFlagReplicationUnfriendly
+	case 1:
+		annotation.KeyspaceID = keyspaceIDs[0]
+	default:
+		annotation.KeyspaceIDs = keyspaceIDs
+	}
+	return annotation
+}
+
+// Decode extracts the keyspace ids and trailing comments carried by a
+// StatementAnnotation, the structured counterpart to ExtractKeySpaceIDs.
+// It returns an error of the same kinds ExtractKeySpaceIDs returns: a
+// ExtractKeySpaceIDReplicationUnfriendlyError if annotation marks the
+// statement as replication-unfriendly, and a ExtractKeySpaceIDParseError
+// if annotation is nil or carries no keyspace id for some other reason.
+func Decode(annotation *proto.StatementAnnotation) (keyspaceIDs [][]byte, trailingComments string, err error) {
+	if annotation == nil {
+		return nil, "", &ExtractKeySpaceIDError{
+			Kind:    ExtractKeySpaceIDParseError,
+			Message: "No annotation found",
+		}
+	}
+	trailingComments = annotation.TrailingComments
+	if annotation.Flags&proto.StatementAnnotationFlagReplicationUnfriendly != 0 {
+		return nil, trailingComments, &ExtractKeySpaceIDError{
+			Kind:    ExtractKeySpaceIDReplicationUnfriendlyError,
+			Message: "Statement annotation is marked replication-unfriendly",
+		}
+	}
+	if annotation.KeyspaceID != nil {
+		return [][]byte{annotation.KeyspaceID}, trailingComments, nil
+	}
+	if len(annotation.KeyspaceIDs) > 0 {
+		return annotation.KeyspaceIDs, trailingComments, nil
+	}
+	return nil, trailingComments, &ExtractKeySpaceIDError{
+		Kind:    ExtractKeySpaceIDParseError,
+		Message: "Annotation carries no keyspace id",
+	}
+}
+
 // Extracts the string from source contained between the leftmost instance of
 // 'leftDelim' and the next instance of 'rightDelim'. If there is no next instance
 // of 'rightDelim', returns the string contained between the end of the leftmost instance
@@ -0,0 +1,129 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqlannotation
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/youtube/vitess/go/vt/binlog/proto"
+)
+
+func TestAddKeyspaceIDsAndExtractKeySpaceIDs(t *testing.T) {
+	keyspaceIDs := [][]byte{[]byte("a"), []byte("bb"), []byte("ccc")}
+	annotated := AddKeyspaceIDs("update t set x=1", keyspaceIDs, " /* trailer */")
+	got, err := ExtractKeySpaceIDs(annotated)
+	if err != nil {
+		t.Fatalf("ExtractKeySpaceIDs(%q) failed: %v", annotated, err)
+	}
+	if !reflect.DeepEqual(got, keyspaceIDs) {
+		t.Errorf("ExtractKeySpaceIDs(%q) = %v, want %v", annotated, got, keyspaceIDs)
+	}
+}
+
+func TestExtractKeySpaceIDsAcceptsSingleIDForm(t *testing.T) {
+	annotated := AddKeyspaceID("delete from t where x=1", []byte("a"), "")
+	got, err := ExtractKeySpaceIDs(annotated)
+	if err != nil {
+		t.Fatalf("ExtractKeySpaceIDs(%q) failed: %v", annotated, err)
+	}
+	want := [][]byte{[]byte("a")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ExtractKeySpaceIDs(%q) = %v, want %v", annotated, got, want)
+	}
+}
+
+func TestExtractKeySpaceIDRejectsMultiIDForm(t *testing.T) {
+	annotated := AddKeyspaceIDs("update t set x=1", [][]byte{[]byte("a"), []byte("b")}, "")
+	if _, err := ExtractKeySpaceID(annotated); err == nil {
+		t.Errorf("ExtractKeySpaceID(%q) succeeded, want error (use ExtractKeySpaceIDs)", annotated)
+	}
+}
+
+func TestAnnotateIfDMLUsesKeyspaceIDsForMultipleIDs(t *testing.T) {
+	sql := AnnotateIfDML("insert into t values (1)", [][]byte{[]byte("a"), []byte("b")})
+	if !bytes.Contains([]byte(sql), []byte("keyspace_ids:")) {
+		t.Errorf("AnnotateIfDML with multiple keyspace ids = %q, want a keyspace_ids annotation", sql)
+	}
+	if _, err := ExtractKeySpaceIDs(sql); err != nil {
+		t.Errorf("ExtractKeySpaceIDs(%q) failed: %v", sql, err)
+	}
+}
+
+func TestAnnotateIfDMLUnfriendlyWithNoKeyspaceIDs(t *testing.T) {
+	sql := AnnotateIfDML("insert into t values (1)", nil)
+	if _, err := ExtractKeySpaceIDs(sql); err == nil {
+		t.Errorf("ExtractKeySpaceIDs(%q) succeeded, want replication-unfriendly error", sql)
+	}
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	keyspaceIDs := [][]byte{[]byte("a"), []byte("bb")}
+	annotation := Encode(keyspaceIDs, "trailer")
+	gotIDs, gotTrailer, err := Decode(annotation)
+	if err != nil {
+		t.Fatalf("Decode(Encode(...)) failed: %v", err)
+	}
+	if !reflect.DeepEqual(gotIDs, keyspaceIDs) {
+		t.Errorf("Decode(Encode(%v)) keyspaceIDs = %v, want %v", keyspaceIDs, gotIDs, keyspaceIDs)
+	}
+	if gotTrailer != "trailer" {
+		t.Errorf("Decode(Encode(...)) trailingComments = %q, want %q", gotTrailer, "trailer")
+	}
+}
+
+func TestEncodeDecodeSingleID(t *testing.T) {
+	keyspaceIDs := [][]byte{[]byte("a")}
+	gotIDs, _, err := Decode(Encode(keyspaceIDs, ""))
+	if err != nil {
+		t.Fatalf("Decode(Encode(...)) failed: %v", err)
+	}
+	if !reflect.DeepEqual(gotIDs, keyspaceIDs) {
+		t.Errorf("Decode(Encode(%v)) = %v, want %v", keyspaceIDs, gotIDs, keyspaceIDs)
+	}
+}
+
+func TestEncodeDecodeReplicationUnfriendly(t *testing.T) {
+	// A nil/empty keyspaceIDs must still encode to a non-nil annotation
+	// so that Decode can round-trip it to the unfriendly error, the same
+	// way AnnotateIfDML's comment-based fallback does.
+	annotation := Encode(nil, "")
+	if annotation == nil {
+		t.Fatal("Encode(nil, \"\") = nil, want a non-nil replication-unfriendly annotation")
+	}
+	_, _, err := Decode(annotation)
+	extractErr, ok := err.(*ExtractKeySpaceIDError)
+	if !ok || extractErr.Kind != ExtractKeySpaceIDReplicationUnfriendlyError {
+		t.Errorf("Decode(Encode(nil, \"\")) error = %v, want ExtractKeySpaceIDReplicationUnfriendlyError", err)
+	}
+}
+
+func TestAnnotateStatementNegotiatesEncoding(t *testing.T) {
+	keyspaceIDs := [][]byte{[]byte("a")}
+
+	sql, annotation := AnnotateStatement("insert into t values (1)", keyspaceIDs, proto.AnnotationCapabilityComment)
+	if annotation != nil {
+		t.Errorf("AnnotateStatement with AnnotationCapabilityComment returned a structured annotation: %v", annotation)
+	}
+	if _, err := ExtractKeySpaceIDs(sql); err != nil {
+		t.Errorf("ExtractKeySpaceIDs(%q) failed: %v", sql, err)
+	}
+
+	sql, annotation = AnnotateStatement("insert into t values (1)", keyspaceIDs, proto.AnnotationCapabilityStructured)
+	if annotation == nil {
+		t.Fatal("AnnotateStatement with AnnotationCapabilityStructured returned a nil annotation")
+	}
+	if sql != "insert into t values (1)" {
+		t.Errorf("AnnotateStatement with AnnotationCapabilityStructured modified sql: %q", sql)
+	}
+	gotIDs, _, err := Decode(annotation)
+	if err != nil {
+		t.Fatalf("Decode(annotation) failed: %v", err)
+	}
+	if !reflect.DeepEqual(gotIDs, keyspaceIDs) {
+		t.Errorf("Decode(annotation) = %v, want %v", gotIDs, keyspaceIDs)
+	}
+}